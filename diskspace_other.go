@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package fastdl
+
+import "errors"
+
+// freeSpace can't tell here, so the disk space check lets downloads through
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space unknown on this platform")
+}
@@ -0,0 +1,1691 @@
+package fastdl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// testConfig returns a config that downloads into a temp dir, without
+// waiting between retries or for the network to come back
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	config := DefaultConfig()
+	config.DownloadDir = t.TempDir()
+	config.DatabasePath = filepath.Join(t.TempDir(), "fastdl.db")
+	config.RetryDelay = 0
+	config.MaxNetworkWait = 0
+	config.StallTimeout = 5
+	return config
+}
+
+func testManager(t *testing.T, config *Config) *DownloadManager {
+	t.Helper()
+	dm, err := NewDownloadManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dm
+}
+
+// testData returns n bytes of reproducible noise
+func testData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// serveData answers HEAD and (ranged) GET requests for data with a strong
+// ETag, like a plain static file server
+func serveData(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("ETag", `"test-etag"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// downloadFile runs a single-stream download of url into config's download dir
+func downloadFile(t *testing.T, dm *DownloadManager, url string, chunks int) (string, error) {
+	t.Helper()
+	task := &DownloadTask{URL: url, Filepath: "file.bin", Chunks: chunks}
+	_, err := dm.Download(context.Background(), task)
+	return filepath.Join(dm.config.DownloadDir, "file.bin"), err
+}
+
+func TestDownloadSingleTruncated(t *testing.T) {
+	data := testData(256 * 1024)
+	var gets, ranged int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.Header.Get("Range") != "" {
+				atomic.AddInt32(&ranged, 1)
+			}
+			if atomic.AddInt32(&gets, 1) == 1 {
+				// Promise the whole file, send half of it and hang up
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(data[:len(data)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	dm := testManager(t, testConfig(t))
+	path, err := downloadFile(t, dm, srv.URL+"/file.bin", 1)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated download: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("truncated download left a file under the final name")
+	}
+
+	// The next run picks up the partial file with a Range request
+	if _, err := downloadFile(t, dm, srv.URL+"/file.bin", 1); err != nil {
+		t.Fatalf("resumed download: %v", err)
+	}
+	if ranged != 1 {
+		t.Errorf("resumed download sent %d ranged requests, want 1", ranged)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("resumed file differs: %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestDownloadSingleTruncatedNoRanges(t *testing.T) {
+	data := testData(64 * 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(data[:len(data)-1000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	dm := testManager(t, testConfig(t))
+	path, err := downloadFile(t, dm, srv.URL+"/file.bin", 1)
+	if err == nil {
+		t.Fatal("download of a truncated body succeeded")
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("truncated download left a file under the final name")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	data := testData(256 * 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	changed := append([]byte(nil), data...)
+	changed[len(changed)-1] ^= 0xff
+	tests := []struct {
+		name    string
+		local   []byte
+		skipped bool
+	}{
+		{"empty", nil, false},
+		{"prefix", data[:100*1024], false},
+		{"same", data, true},
+		{"same size, changed end", changed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t)
+			config.Append = true
+			dm := testManager(t, config)
+			path := filepath.Join(config.DownloadDir, "file.bin")
+			if err := os.WriteFile(path, tt.local, 0644); err != nil {
+				t.Fatal(err)
+			}
+			task := &DownloadTask{URL: srv.URL + "/file.bin", Filepath: "file.bin", Chunks: 1}
+			if _, err := dm.Download(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			if task.Skipped != tt.skipped {
+				t.Errorf("skipped = %v, want %v", task.Skipped, tt.skipped)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("file differs from the remote one (%d bytes, %v)", len(got), err)
+			}
+		})
+	}
+
+	// A failed append leaves the local file as it was
+	local := data[:100*1024]
+	failures := []struct {
+		name string
+		fail func(w http.ResponseWriter)
+	}{
+		{"error status", func(w http.ResponseWriter) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}},
+		{"cut off", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", len(local), len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-len(local)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[len(local) : len(local)+1000])
+			panic(http.ErrAbortHandler)
+		}},
+	}
+	for _, tt := range failures {
+		t.Run("failed "+tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-", len(local)) {
+					tt.fail(w)
+					return
+				}
+				serveData(w, r, data)
+			}))
+			defer srv.Close()
+
+			config := testConfig(t)
+			config.Append = true
+			config.MaxRetries = 1
+			dm := testManager(t, config)
+			path := filepath.Join(config.DownloadDir, "file.bin")
+			if err := os.WriteFile(path, local, 0644); err != nil {
+				t.Fatal(err)
+			}
+			task := &DownloadTask{URL: srv.URL + "/file.bin", Filepath: "file.bin", Chunks: 1}
+			if _, err := dm.Download(context.Background(), task); err == nil {
+				t.Fatal("append from a failing server succeeded")
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, local) {
+				t.Errorf("local file not restored (%d bytes, %v)", len(got), err)
+			}
+		})
+	}
+}
+
+func TestHostSlotsReleasedOnError(t *testing.T) {
+	data := testData(256 * 1024)
+	var broken atomic.Bool
+	broken.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && broken.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	config := testConfig(t)
+	config.MaxConnsPerHost = 1
+	config.MaxRetries = 1
+	dm := testManager(t, config)
+	for _, chunks := range []int{1, 4} {
+		broken.Store(true)
+		if _, err := downloadFile(t, dm, srv.URL+"/file.bin", chunks); err == nil {
+			t.Fatalf("%d chunks: download from a failing server succeeded", chunks)
+		}
+		// A slot leaked by the failure would leave this one waiting forever
+		broken.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		task := &DownloadTask{URL: srv.URL + "/file.bin", Filepath: "file.bin", Chunks: chunks}
+		_, err := dm.Download(ctx, task)
+		cancel()
+		if err != nil {
+			t.Fatalf("%d chunks: download after a failed one: %v", chunks, err)
+		}
+	}
+}
+
+func TestZeroRetriesStillDownloads(t *testing.T) {
+	data := testData(256 * 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	// -limit-retries-per-chunk 0 bypasses Validate; each chunk still gets
+	// its one attempt
+	config := testConfig(t)
+	config.MaxRetries = 0
+	dm := testManager(t, config)
+	path, err := downloadFile(t, dm, srv.URL+"/file.bin", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("file differs from the served one (%d bytes, %v)", len(got), err)
+	}
+}
+
+func TestSingleStreamDigestAfterResume(t *testing.T) {
+	data := testData(256 * 1024)
+	var gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && atomic.AddInt32(&gets, 1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/3])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	sha := sha256.Sum256(data)
+	sum := md5.Sum(data)
+	config := testConfig(t)
+	config.WriteChecksum = true
+	config.ChecksumAlgorithm = "md5"
+	dm := testManager(t, config)
+	if _, err := downloadFile(t, dm, srv.URL+"/file.bin", 1); err == nil {
+		t.Fatal("truncated download succeeded")
+	}
+
+	// The resumed run hashes the kept third and then the rest as it arrives
+	task := &DownloadTask{URL: srv.URL + "/file.bin", Filepath: "file.bin", Chunks: 1, SHA256: hex.EncodeToString(sha[:])}
+	if _, err := dm.Download(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	if !task.hashedFile {
+		t.Error("the single stream wasn't hashed as it was written")
+	}
+	sidecar, err := os.ReadFile(filepath.Join(config.DownloadDir, "file.bin.md5"))
+	if want := hex.EncodeToString(sum[:]) + "  file.bin\n"; err != nil || string(sidecar) != want {
+		t.Errorf("sidecar %q (%v), want %q", sidecar, err, want)
+	}
+}
+
+func TestResumeValidation(t *testing.T) {
+	data := testData(256 * 1024)
+	before, after := time.Unix(1700000000, 0), time.Unix(1700003600, 0)
+	for _, tc := range []struct {
+		name           string
+		etags          [2]string    // served by the interrupted and the second run
+		modified       [2]time.Time // likewise, zero for no Last-Modified
+		force, resumed bool
+	}{
+		{"same strong etag", [2]string{`"a"`, `"a"`}, [2]time.Time{}, false, true},
+		{"etag changed", [2]string{`"a"`, `"b"`}, [2]time.Time{}, false, false},
+		{"same last-modified", [2]string{}, [2]time.Time{before, before}, false, true},
+		{"last-modified changed", [2]string{}, [2]time.Time{before, after}, false, false},
+		{"weak etag", [2]string{`W/"a"`, `W/"a"`}, [2]time.Time{}, false, false},
+		{"weak etag and last-modified", [2]string{`W/"a"`, `W/"a"`}, [2]time.Time{before, before}, false, true},
+		{"weak etag, forced", [2]string{`W/"a"`, `W/"a"`}, [2]time.Time{}, true, true},
+		{"etag changed, forced", [2]string{`"a"`, `"b"`}, [2]time.Time{}, true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			run, gets, ranged := 0, 0, false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				etag, modified := tc.etags[run], tc.modified[run]
+				first := r.Method == http.MethodGet && gets == 0
+				if r.Method == http.MethodGet {
+					gets++
+					ranged = ranged || (!first && r.Header.Get("Range") != "")
+				}
+				mu.Unlock()
+				if etag != "" {
+					w.Header().Set("ETag", etag)
+				}
+				if first {
+					if !modified.IsZero() {
+						w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+					}
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.WriteHeader(http.StatusOK)
+					w.Write(data[:len(data)/3])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				http.ServeContent(w, r, "", modified, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			config := testConfig(t)
+			config.ForceResume = tc.force
+			dm := testManager(t, config)
+			if _, err := downloadFile(t, dm, srv.URL+"/file.bin", 1); err == nil {
+				t.Fatal("interrupted download succeeded")
+			}
+			mu.Lock()
+			run = 1
+			mu.Unlock()
+			path, err := downloadFile(t, dm, srv.URL+"/file.bin", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("file differs from the served one (%d bytes, %v)", len(got), err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ranged != tc.resumed {
+				t.Errorf("resumed = %v, want %v", ranged, tc.resumed)
+			}
+		})
+	}
+}
+
+func TestGPGSignature(t *testing.T) {
+	data := testData(64 * 1024)
+	tampered := append([]byte(nil), data...)
+	tampered[0] ^= 0xff
+
+	// Throwaway keys: the release key, and another one nobody trusts
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	release, err := openpgp.NewEntity("fastdl test", "", "release@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("someone else", "", "other@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	armored, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := release.Serialize(armored); err != nil {
+		t.Fatal(err)
+	}
+	armored.Close()
+	keyPath := filepath.Join(t.TempDir(), "release-key.asc")
+	if err := os.WriteFile(keyPath, key.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signatures := make(map[string][]byte)
+	for name, sign := range map[string]func(w *bytes.Buffer) error{
+		"/good.asc": func(w *bytes.Buffer) error {
+			return openpgp.ArmoredDetachSign(w, release, bytes.NewReader(data), nil)
+		},
+		"/good.sig": func(w *bytes.Buffer) error {
+			return openpgp.DetachSign(w, release, bytes.NewReader(data), nil)
+		},
+		"/tampered.sig": func(w *bytes.Buffer) error {
+			return openpgp.DetachSign(w, release, bytes.NewReader(tampered), nil)
+		},
+		"/other.asc": func(w *bytes.Buffer) error {
+			return openpgp.ArmoredDetachSign(w, other, bytes.NewReader(data), nil)
+		},
+	} {
+		var sig bytes.Buffer
+		if err := sign(&sig); err != nil {
+			t.Fatal(err)
+		}
+		signatures[name] = sig.Bytes()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sig, ok := signatures[r.URL.Path]; ok {
+			w.Write(sig)
+			return
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		signature string
+		good      bool
+	}{
+		{"/good.asc", true},
+		{"/good.sig", true},
+		{"/tampered.sig", false},
+		{"/other.asc", false},
+	} {
+		t.Run(strings.TrimPrefix(tc.signature, "/"), func(t *testing.T) {
+			config := testConfig(t)
+			dm := testManager(t, config)
+			task := &DownloadTask{URL: srv.URL + "/file.bin", Filepath: "file.bin", Chunks: 2,
+				GPGSignatureURL: srv.URL + tc.signature, GPGKeyFile: keyPath}
+			_, err := dm.Download(context.Background(), task)
+			path := filepath.Join(config.DownloadDir, "file.bin")
+			if tc.good {
+				if err != nil {
+					t.Fatalf("good signature rejected: %v", err)
+				}
+				if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+					t.Errorf("file differs from the served one (%d bytes, %v)", len(got), err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrBadSignature) {
+				t.Fatalf("error %v, want %v", err, ErrBadSignature)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("file saved under its name despite the bad signature (%v)", err)
+			}
+			if _, err := os.Stat(path + ".bad"); err != nil {
+				t.Errorf("not kept as .bad: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadJobsAfterRestart(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "jobs.db")
+	jq, err := NewJobQueue(2, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{
+		"queued":      "pending",
+		"interrupted": "downloading",
+		"done":        "completed",
+		"broken":      "failed",
+		"held":        "paused",
+	}
+	for id, status := range statuses {
+		if err := jq.AddJob(&Job{ID: id, URL: "http://example.com/" + id}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jq.db.Exec("UPDATE jobs SET status = ? WHERE id = ?", status, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jq.Close()
+
+	jq, err = NewJobQueue(2, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+
+	if len(jq.jobs) != len(statuses) {
+		t.Fatalf("loaded %d jobs, want %d", len(jq.jobs), len(statuses))
+	}
+	want := map[string]string{
+		"queued":      "pending",
+		"interrupted": "pending", // an interrupted download starts over as pending
+		"done":        "completed",
+		"broken":      "failed",
+		"held":        "paused",
+	}
+	for id, status := range want {
+		if job := jq.jobs[id]; job == nil || job.Status != status {
+			t.Errorf("job %s: got %+v, want status %s", id, job, status)
+		}
+	}
+	queued := map[string]bool{}
+	for _, job := range jq.queue {
+		queued[job.ID] = true
+	}
+	if len(queued) != 2 || !queued["queued"] || !queued["interrupted"] {
+		t.Errorf("queue holds %v, want queued and interrupted", queued)
+	}
+	if len(jq.completed) != 1 || jq.completed["done"] == nil {
+		t.Errorf("completed holds %v, want done", jq.completed)
+	}
+	if len(jq.failed) != 1 || jq.failed["broken"] == nil {
+		t.Errorf("failed holds %v, want broken", jq.failed)
+	}
+	if len(jq.active) != 0 {
+		t.Errorf("active holds %v after a restart, want nothing", jq.active)
+	}
+}
+
+func TestHistorySkipsUnchanged(t *testing.T) {
+	jq, err := NewJobQueue(2, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+
+	end := time.Now()
+	start := end.Add(-10 * time.Second)
+	for _, unchanged := range []bool{false, true} {
+		id := fmt.Sprintf("unchanged-%v", unchanged)
+		if err := jq.AddJob(&Job{ID: id, URL: "http://example.com/" + id}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jq.db.Exec("UPDATE jobs SET status = 'completed', downloaded = 1000, start_time = ?, end_time = ?, unchanged = ? WHERE id = ?",
+			start, end, unchanged, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := jq.History(end.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total.Jobs != 2 || report.Total.Bytes != 1000 {
+		t.Errorf("total %+v, want 2 jobs and 1000 bytes", report.Total)
+	}
+	if speed := report.Total.Speed(); speed < 99 || speed > 101 {
+		t.Errorf("speed %.1f B/s, want 100 as if only the changed job ran", speed)
+	}
+	if len(report.Hosts) != 1 || report.Hosts[0].Bytes != 1000 {
+		t.Errorf("hosts %+v, want example.com with 1000 bytes", report.Hosts)
+	}
+}
+
+func TestExportImportJobs(t *testing.T) {
+	src, err := NewJobQueue(1, filepath.Join(t.TempDir(), "src.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	noVerify := false
+	for _, job := range []*Job{
+		{ID: "done", URL: "http://example.com/done"},
+		{ID: "base", URL: "http://example.com/base"},
+		{ID: "child", URL: "http://example.com/child", DependsOn: []string{"base", "done"}, VerifyChecksum: &noVerify},
+	} {
+		if err := src.AddJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.mu.Lock()
+	src.jobs["done"].Status = "completed"
+	for i, id := range []string{"done", "base", "child"} {
+		src.jobs[id].AddedTime = time.Unix(int64(1000+i), 0)
+	}
+	src.mu.Unlock()
+
+	// Through JSON, the way /api/jobs/export and /api/jobs/import pass it
+	data, err := json.Marshal(src.ExportJobs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name       string
+		regenerate bool
+		status     map[string]string // BulkResult status by exported ID
+		baseID     bool              // base keeps its ID
+	}{
+		{"skip taken IDs", false, map[string]string{"done": "skipped", "base": "skipped", "child": "added"}, true},
+		{"renumber taken IDs", true, map[string]string{"done": "skipped", "base": "added", "child": "added"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var jobs []Job
+			if err := json.Unmarshal(data, &jobs); err != nil {
+				t.Fatal(err)
+			}
+			dst, err := NewJobQueue(1, filepath.Join(t.TempDir(), "dst.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+			if err := dst.AddJob(&Job{ID: "base", URL: "http://example.com/other"}); err != nil {
+				t.Fatal(err)
+			}
+
+			results := dst.ImportJobs(jobs, tc.regenerate)
+			if len(results) != 3 {
+				t.Fatalf("%d results, want one per exported job: %+v", len(results), results)
+			}
+			var baseID string
+			for i, id := range []string{"done", "base", "child"} {
+				if results[i].Status != tc.status[id] {
+					t.Errorf("%s: %s (%s), want %s", id, results[i].Status, results[i].Error, tc.status[id])
+				}
+				if id == "base" {
+					baseID = results[i].ID
+				}
+			}
+			if (baseID == "base") != tc.baseID {
+				t.Errorf("imported base as %s", baseID)
+			}
+
+			dst.mu.RLock()
+			defer dst.mu.RUnlock()
+			if _, ok := dst.jobs["done"]; ok {
+				t.Errorf("the completed job was imported")
+			}
+			child := dst.jobs["child"]
+			if child == nil {
+				t.Fatal("child job not imported")
+			}
+			// The completed dependency is dropped; base is followed to its ID
+			if !reflect.DeepEqual(child.DependsOn, []string{baseID}) {
+				t.Errorf("child depends on %v, want [%s]", child.DependsOn, baseID)
+			}
+			if child.VerifyChecksum == nil || *child.VerifyChecksum {
+				t.Errorf("child verify_checksum %v, want false", child.VerifyChecksum)
+			}
+			if !tc.regenerate && dst.jobs["base"].URL != "http://example.com/other" {
+				t.Errorf("the existing base job was replaced")
+			}
+		})
+	}
+}
+
+func TestJobOverMaxFileSize(t *testing.T) {
+	data := testData(256 * 1024)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	config := testConfig(t)
+	config.MaxFileSize = 100 * 1024
+	jq, err := NewJobQueue(1, config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+	jq.SetManager(testManager(t, config))
+
+	// The size of a new job is learnt from the server, an imported one's is known
+	for _, job := range []*Job{
+		{ID: "new", URL: srv.URL + "/new.bin", FilePath: "new.bin"},
+		{ID: "imported", URL: srv.URL + "/imported.bin", FilePath: "imported.bin", TotalSize: int64(len(data))},
+	} {
+		if err := jq.AddJob(job); err != nil {
+			t.Fatal(err)
+		}
+		before := atomic.LoadInt32(&requests)
+		jq.processNext()
+		jq.mu.Lock()
+		done := jq.done[job.ID]
+		jq.mu.Unlock()
+		if done == nil {
+			t.Fatalf("job %s did not start", job.ID)
+		}
+		<-done
+		if job.Status != "failed" || !strings.Contains(job.Error, ErrTooLarge.Error()) {
+			t.Errorf("job %s: status %s, error %q; want it failed as too large", job.ID, job.Status, job.Error)
+		}
+		if job.ID == "imported" && atomic.LoadInt32(&requests) != before {
+			t.Errorf("the imported job of known size still asked the server")
+		}
+	}
+}
+
+func TestBulkPauseStopsActiveJob(t *testing.T) {
+	const size = 1 << 20
+	requested := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		if r.Method != http.MethodGet {
+			return
+		}
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		// Trickle the body until the client goes away
+		for sent := 0; sent < size; sent += 1024 {
+			if _, err := w.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer srv.Close()
+
+	config := testConfig(t)
+	jq, err := NewJobQueue(1, config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+	jq.SetManager(testManager(t, config))
+	d := NewDaemonServer(config, jq)
+
+	job := &Job{ID: "slow", URL: srv.URL + "/slow.bin", FilePath: "slow.bin"}
+	if err := jq.AddJob(job); err != nil {
+		t.Fatal(err)
+	}
+	jq.processNext()
+	<-requested
+
+	body := strings.NewReader(`{"action":"pause","ids":["slow"]}`)
+	rec := httptest.NewRecorder()
+	d.handleBulkJobs(rec, httptest.NewRequest(http.MethodPost, "/api/jobs/bulk", body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk pause: %d %s", rec.Code, rec.Body)
+	}
+
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	if len(jq.active) != 0 {
+		t.Errorf("job still active after the bulk pause answered")
+	}
+	if job.Status != "paused" {
+		t.Errorf("status %s after pausing, want paused", job.Status)
+	}
+	if err := jq.resumeJob("slow"); err != nil {
+		t.Errorf("resume after pause: %v", err)
+	}
+}
+
+// rpcReply is any message from the JSON-RPC server: a response or a
+// "progress" notification
+type rpcReply struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params rpcJobProgress  `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func TestRPC(t *testing.T) {
+	jq, err := NewJobQueue(1, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+	d := NewDaemonServer(testConfig(t), jq)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go d.serveRPC(server)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	enc, dec := json.NewEncoder(client), json.NewDecoder(client)
+	next := func() rpcReply {
+		t.Helper()
+		var reply rpcReply
+		if err := dec.Decode(&reply); err != nil {
+			t.Fatalf("reading a reply: %v", err)
+		}
+		return reply
+	}
+	// call returns the response to a request, skipping notifications
+	call := func(id int, method string, params interface{}) rpcReply {
+		t.Helper()
+		req := map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+		if err := enc.Encode(req); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if reply := next(); reply.Method == "" {
+				if string(reply.ID) != strconv.Itoa(id) {
+					t.Fatalf("%s: reply to request %s", method, reply.ID)
+				}
+				return reply
+			}
+		}
+	}
+
+	reply := call(1, "AddJob", map[string]string{"id": "a", "url": "http://example.com/a.bin", "file_path": "a.bin"})
+	if reply.Error != nil || !strings.Contains(string(reply.Result), `"id":"a"`) {
+		t.Fatalf("AddJob: %s %+v", reply.Result, reply.Error)
+	}
+	if reply := call(2, "AddJob", map[string]string{"url": "not a url"}); reply.Error == nil || reply.Error.Code != rpcInvalidParams {
+		t.Errorf("AddJob with a bad URL: %+v, want invalid params", reply.Error)
+	}
+	if reply := call(3, "PauseJob", map[string]string{"id": "a"}); reply.Error != nil {
+		t.Fatalf("PauseJob: %+v", reply.Error)
+	}
+	if reply := call(4, "PauseJob", map[string]string{"id": "missing"}); reply.Error == nil || reply.Error.Code != rpcJobNotFound {
+		t.Errorf("PauseJob of an unknown job: %+v, want job not found", reply.Error)
+	}
+	var jobs []Job
+	reply = call(5, "ListJobs", map[string]string{"status": "paused"})
+	if err := json.Unmarshal(reply.Result, &jobs); err != nil || len(jobs) != 1 || jobs[0].ID != "a" {
+		t.Errorf("ListJobs of paused jobs: %s (%v), want job a", reply.Result, err)
+	}
+	if reply := call(6, "Frobnicate", nil); reply.Error == nil || reply.Error.Code != rpcMethodNotFound {
+		t.Errorf("unknown method: %+v", reply.Error)
+	}
+
+	// Not JSON-RPC 2.0: answered with the request's ID, and the connection
+	// stays usable
+	if err := enc.Encode(map[string]interface{}{"id": 7, "method": "ListJobs"}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := next(); string(reply.ID) != "7" || reply.Error == nil || reply.Error.Code != rpcInvalidRequest {
+		t.Errorf("request without jsonrpc: id %s, error %+v", reply.ID, reply.Error)
+	}
+
+	// Watching a job ends once it completes: later changes send nothing
+	reply = call(8, "WatchProgress", map[string]string{"id": "a"})
+	if reply.Error != nil {
+		t.Fatalf("WatchProgress: %+v", reply.Error)
+	}
+	jq.mu.Lock()
+	job := jq.jobs["a"]
+	job.Status = "completed"
+	jq.mu.Unlock()
+	for {
+		if reply := next(); reply.Method == "progress" && reply.Params.Status == "completed" {
+			break
+		}
+	}
+	jq.mu.Lock()
+	job.Downloaded = 1234
+	jq.mu.Unlock()
+	time.Sleep(RPCWatchInterval * 3 / 2)
+	if err := enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 9, "method": "ListJobs"}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := next(); reply.Method != "" || string(reply.ID) != "9" {
+		t.Errorf("got %s %+v after the watched job completed, want the ListJobs response", reply.Method, reply.Params)
+	}
+
+	// Bad JSON can't be skipped over: a parse error, then the connection ends
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := next(); string(reply.ID) != "null" || reply.Error == nil || reply.Error.Code != rpcParseError {
+		t.Errorf("bad JSON: id %s, error %+v", reply.ID, reply.Error)
+	}
+	var rest rpcReply
+	if err := dec.Decode(&rest); err != io.EOF {
+		t.Errorf("connection still open after a parse error: %v", err)
+	}
+}
+
+func TestEstimateStarts(t *testing.T) {
+	jq, err := NewJobQueue(1, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+
+	// a frees its slot in 5s; c is assumed as large as a, so d follows 10s later
+	active := &Job{ID: "a", Status: "downloading", TotalSize: 1000, Downloaded: 500, Speed: 100}
+	blocked := &Job{ID: "b", Status: "pending", DependsOn: []string{"a"}}
+	c := &Job{ID: "c", Status: "pending"}
+	d := &Job{ID: "d", Status: "pending"}
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	for _, job := range []*Job{active, blocked, c, d} {
+		jq.jobs[job.ID] = job
+	}
+	jq.active["a"] = active
+	jq.queue = []*Job{blocked, c, d}
+
+	now := time.Now()
+	starts := jq.estimateStarts(now)
+	if _, ok := starts["b"]; ok {
+		t.Errorf("estimate for a job waiting on its dependency: %v", starts["b"])
+	}
+	if got := starts["c"].Sub(now); got != 5*time.Second {
+		t.Errorf("c starts in %s, want 5s", got)
+	}
+	if got := starts["d"].Sub(now); got != 15*time.Second {
+		t.Errorf("d starts in %s, want 15s", got)
+	}
+}
+
+func TestEstimateStartsPaused(t *testing.T) {
+	jq, err := NewJobQueue(1, filepath.Join(t.TempDir(), "jobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jq.Close()
+	if err := jq.AddJob(&Job{ID: "next", URL: "http://example.com/next"}); err != nil {
+		t.Fatal(err)
+	}
+
+	jq.mu.Lock()
+	defer jq.mu.Unlock()
+	if starts := jq.estimateStarts(time.Now()); starts["next"].IsZero() {
+		t.Fatalf("no estimate for the only queued job: %v", starts)
+	}
+	jq.paused = true
+	if starts := jq.estimateStarts(time.Now()); len(starts) != 0 {
+		t.Errorf("estimates while paused: %v", starts)
+	}
+}
+
+func TestGetFileInfoHeadRefused(t *testing.T) {
+	data := testData(100 * 1000)
+	for _, tc := range []struct {
+		name   string
+		status int
+		ranges bool
+	}{
+		{"405 with ranges", http.StatusMethodNotAllowed, true},
+		{"403 with ranges", http.StatusForbidden, true},
+		{"405 without ranges", http.StatusMethodNotAllowed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var heads int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					atomic.AddInt32(&heads, 1)
+					w.WriteHeader(tc.status)
+					return
+				}
+				if !tc.ranges {
+					// The whole file every time, no Accept-Ranges
+					w.Header().Set("ETag", `"test-etag"`)
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.Write(data)
+					return
+				}
+				serveData(w, r, data)
+			}))
+			defer srv.Close()
+
+			dm := testManager(t, testConfig(t))
+			info, err := dm.GetFileInfo(context.Background(), srv.URL+"/file.bin")
+			if err != nil {
+				t.Fatalf("GetFileInfo: %v", err)
+			}
+			if heads != 1 {
+				t.Errorf("sent %d HEAD requests, want 1", heads)
+			}
+			if info.Size != int64(len(data)) {
+				t.Errorf("size %d, want %d", info.Size, len(data))
+			}
+			if info.SupportsRange != tc.ranges {
+				t.Errorf("SupportsRange %v, want %v", info.SupportsRange, tc.ranges)
+			}
+			if info.ETag != `"test-etag"` {
+				t.Errorf("ETag %q, want the GET response's", info.ETag)
+			}
+
+			path, err := downloadFile(t, dm, srv.URL+"/file.bin", 4)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestParseSizeLarge(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"3G", 3 << 30},
+		{"2.5GB", 5 << 29},
+		{"4GiB", 4 << 30},
+		{"3000000000", 3000000000},
+		{"7E", 7 << 60},
+	} {
+		got, err := ParseSize(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{"8E", "1e30", "-1G", "lots", "inf", "-Inf", "+InfinityK", "nan", "NaN G"} {
+		if got, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	for _, tc := range []struct {
+		name, in string
+		want     []string
+	}{
+		{"plain", "curl  -s\thttps://example.com/a", []string{"curl", "-s", "https://example.com/a"}},
+		{"single quotes", `'a b' 'x"y\z'`, []string{"a b", `x"y\z`}},
+		{"double quotes", `"q \"x\" \$ \\ \y"`, []string{`q "x" $ \ \y`}},
+		{"backslash", `a\ b c\'d`, []string{"a b", "c'd"}},
+		{"adjacent quotes", `'it'\''s' a""b`, []string{"it's", "ab"}},
+		{"empty word", `-H ''`, []string{"-H", ""}},
+		{"ansi-c", `$'a\tb\n' $'it\'s' $'\\'`, []string{"a\tb\n", "it's", `\`}},
+		{"continuation", "curl \\\n  -H 'X: 1' \\\r\n  url", []string{"curl", "-H", "X: 1", "url"}},
+		{"continuation in double quotes", "\"ab\\\ncd\"", []string{"abcd"}},
+		{"newline between words", "a\nb", []string{"a", "b"}},
+	} {
+		got, err := splitShellWords(tc.in)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: splitShellWords(%q) = %q, %v; want %q", tc.name, tc.in, got, err, tc.want)
+		}
+	}
+	for _, in := range []string{`'open`, `"open`, `$'open`, `a "b\"`} {
+		if got, err := splitShellWords(in); err == nil {
+			t.Errorf("splitShellWords(%q) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestParseCurlCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name, command string
+		url, file     string
+		headers       map[string]string
+		err           string // error substring, "" = parses fine
+	}{
+		{
+			name:    "copied from a browser",
+			command: "curl 'https://example.com/f.iso' \\\n  -H 'Accept: */*' \\\n  -H 'accept-encoding: gzip, br' \\\n  -b 'a=1; b=2' \\\n  --compressed",
+			url:     "https://example.com/f.iso",
+			headers: map[string]string{"Accept": "*/*", "Cookie": "a=1; b=2"},
+		},
+		{
+			name:    "cookies joined in order",
+			command: `curl -b a=1 --cookie 'b=2' -H 'Cookie: c=3' --cookie=d=4 https://example.com/f`,
+			url:     "https://example.com/f",
+			headers: map[string]string{"Cookie": "a=1; b=2; c=3; d=4"},
+		},
+		{
+			name:    "header forms",
+			command: `curl -HX-One:1 --header='X-Two: 2' -H "X-Three:  3 " https://example.com/f`,
+			url:     "https://example.com/f",
+			headers: map[string]string{"X-One": "1", "X-Two": "2", "X-Three": "3"},
+		},
+		{
+			name:    "empty header removes it",
+			command: `curl -H 'Accept: a' -H 'Accept:' https://example.com/f`,
+			url:     "https://example.com/f",
+			headers: map[string]string{},
+		},
+		{
+			name:    "ignored switches",
+			command: `/usr/bin/curl -sSL -k --http2 --globoff -# --fail -X get -o out.bin https://example.com/f`,
+			url:     "https://example.com/f",
+			file:    "out.bin",
+			headers: map[string]string{},
+		},
+		{
+			name:    "agent, referer and user",
+			command: `curl -A 'Agent/1.0' -e https://example.com/ -u user:pw --url https://example.com/f`,
+			url:     "https://example.com/f",
+			headers: map[string]string{"User-Agent": "Agent/1.0", "Referer": "https://example.com/", "Authorization": "Basic dXNlcjpwdw=="},
+		},
+		{
+			name:    "ansi-c header",
+			command: `curl $'https://example.com/f' -H $'X-Quote: it\'s'`,
+			url:     "https://example.com/f",
+			headers: map[string]string{"X-Quote": "it's"},
+		},
+		{name: "post", command: `curl -X POST https://example.com/f`, err: "only GET requests"},
+		{name: "request body", command: `curl https://example.com/f --data-raw 'x=1'`, err: "sends a request body"},
+		{name: "form", command: `curl -F a=b https://example.com/f`, err: "sends a request body"},
+		{name: "cookie file", command: `curl -b cookies.txt https://example.com/f`, err: "cookie files are not supported"},
+		{name: "malformed header", command: `curl -H 'no colon' https://example.com/f`, err: "not in Key: Value form"},
+		{name: "no url", command: `curl -sL`, err: "no URL"},
+		{name: "two urls", command: `curl https://example.com/a https://example.com/b`, err: "more than one URL"},
+		{name: "unknown option", command: `curl --tlsv1.3 https://example.com/f`, err: "unsupported option --tlsv1.3"},
+		{name: "unknown bundled switch", command: `curl -sZ https://example.com/f`, err: "unsupported option -sZ"},
+		{name: "missing value", command: `curl https://example.com/f -H`, err: "-H needs a value"},
+		{name: "unterminated quote", command: `curl 'https://example.com/f`, err: "unterminated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			task, err := ParseCurlCommand(tc.command)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("ParseCurlCommand: %v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("ParseCurlCommand accepted %s", tc.command)
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("error %q, want it to contain %q", err, tc.err)
+			case tc.err != "":
+				return
+			}
+			if task.URL != tc.url || task.Filepath != tc.file {
+				t.Errorf("URL %q, file %q; want %q, %q", task.URL, task.Filepath, tc.url, tc.file)
+			}
+			if !reflect.DeepEqual(task.Headers, tc.headers) {
+				t.Errorf("headers %q, want %q", task.Headers, tc.headers)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetLimitWhileWaiting(t *testing.T) {
+	rl := NewRateLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl.Wait(ctx, 1000) // drain the burst, so the next Wait sleeps for a second
+	waiting := make(chan struct{})
+	go func() {
+		close(waiting)
+		rl.Wait(ctx, 1000)
+	}()
+	<-waiting
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	rl.SetLimit(2000)
+	if took := time.Since(start); took > 200*time.Millisecond {
+		t.Errorf("SetLimit took %s behind a waiting reader", took)
+	}
+}
+
+func TestRateLimiterAbove2GBps(t *testing.T) {
+	for _, limit := range []int64{math.MaxInt32 + 1, 3 << 30, 1 << 40, math.MaxInt64} {
+		if burst := rateBurst(limit); burst != RateBurst {
+			t.Errorf("rateBurst(%d) = %d, want %d", limit, burst, RateBurst)
+		}
+		rl := NewRateLimiter(limit)
+		if rl.Limit() != limit {
+			t.Errorf("NewRateLimiter(%d).Limit() = %d", limit, rl.Limit())
+		}
+		if burst := rl.limiter.Burst(); burst != RateBurst {
+			t.Errorf("limit %d: burst %d, want %d", limit, burst, RateBurst)
+		}
+		// A read larger than the burst goes through in burst-sized steps
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := rl.Wait(ctx, 16*RateBurst); err != nil {
+			t.Errorf("limit %d: Wait: %v", limit, err)
+		}
+		cancel()
+
+		rl = NewRateLimiter(1000)
+		rl.SetLimit(limit)
+		if rl.Limit() != limit || rl.limiter.Burst() != RateBurst {
+			t.Errorf("SetLimit(%d): limit %d, burst %d", limit, rl.Limit(), rl.limiter.Burst())
+		}
+	}
+	if burst := rateBurst(1000); burst != 1000 {
+		t.Errorf("rateBurst(1000) = %d, want a second's worth", burst)
+	}
+}
+
+// BenchmarkCopyBody measures the read loop of downloadSingle and
+// downloadChunk: a body through bodyReader (stall watchdog, throttle,
+// progress) into a file-like writer. "pooled" takes its buffer from the
+// manager's pool, "per-call" allocates one per body as before the pool.
+func BenchmarkCopyBody(b *testing.B) {
+	payload := testData(1 << 20)
+	config := DefaultConfig()
+	dm, err := NewDownloadManager(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	task := &DownloadTask{}
+	progress := &ProgressInfo{Total: int64(len(payload))}
+	newBody := func() *bodyReader {
+		return &bodyReader{
+			ctx:      context.Background(),
+			dm:       dm,
+			task:     task,
+			body:     bytes.NewReader(payload),
+			watchdog: newStallWatchdog(30*time.Second, func() {}),
+			progress: progress,
+		}
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			pooled := dm.getBuffer()
+			if _, err := io.CopyBuffer(writerOnly{io.Discard}, newBody(), *pooled); err != nil {
+				b.Fatal(err)
+			}
+			dm.putBuffer(pooled)
+		}
+	})
+	b.Run("per-call", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			buf := make([]byte, BufferSize)
+			if _, err := io.CopyBuffer(writerOnly{io.Discard}, newBody(), buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// multipartServer answers ranged GETs with a multipart/byteranges body:
+// the requested range alone, or behind a part the request didn't ask for
+func multipartServer(data []byte, decoy bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"test-etag"`)
+		var first, last int64
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); n == 0 || r.Method == http.MethodHead {
+			serveData(w, r, data)
+			return
+		} else if n == 1 {
+			last = int64(len(data)) - 1
+		}
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		writePart := func(first, last int64) {
+			part, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", first, last, len(data))},
+			})
+			part.Write(data[first : last+1])
+		}
+		if decoy {
+			writePart(0, 9)
+		}
+		writePart(first, last)
+		mw.Close()
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body.Bytes())
+	}))
+}
+
+func TestMultipartByteranges(t *testing.T) {
+	data := testData(200 * 1000)
+	for _, tc := range []struct {
+		name  string
+		decoy bool
+	}{
+		{"single part", false},
+		{"multi part", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := multipartServer(data, tc.decoy)
+			defer srv.Close()
+
+			dm := testManager(t, testConfig(t))
+			path, err := downloadFile(t, dm, srv.URL+"/file.bin", 4)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+				t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestParseBatchFileAria2(t *testing.T) {
+	type item struct {
+		url     string
+		mirrors []string
+		file    string
+		dir     string
+		sha256  string
+		headers map[string]string
+	}
+	for _, tc := range []struct {
+		name, content string
+		want          []item
+	}{
+		{
+			name: "options",
+			content: "https://example.com/a.iso\thttps://mirror.example.com/a.iso\n" +
+				"  out=renamed.iso\n" +
+				"\tdir=isos\n" +
+				"  header=X-Token: abc\n" +
+				"  checksum=sha-256=ABC\n",
+			want: []item{{url: "https://example.com/a.iso", mirrors: []string{"https://mirror.example.com/a.iso"},
+				file: "renamed.iso", dir: "isos", sha256: "ABC", headers: map[string]string{"X-Token": "abc"}}},
+		},
+		{
+			name: "options apply to the URI above",
+			content: "https://example.com/a\n  out=first.bin\n" +
+				"https://example.com/b\n  out=second.bin\n",
+			want: []item{
+				{url: "https://example.com/a", file: "first.bin", headers: map[string]string{}},
+				{url: "https://example.com/b", file: "second.bin", headers: map[string]string{}},
+			},
+		},
+		{
+			name:    "comments and blank lines",
+			content: "# downloads\nhttps://example.com/a\n\n   # an indented comment\n  out=a.bin\n",
+			want:    []item{{url: "https://example.com/a", file: "a.bin", headers: map[string]string{}}},
+		},
+		{
+			name:    "bad option lines are ignored",
+			content: "https://example.com/a\n  out\n  split=4\n  header=no colon\n  dir=d\n",
+			want:    []item{{url: "https://example.com/a", dir: "d", headers: map[string]string{}}},
+		},
+		{
+			name:    "options without a URI",
+			content: "  out=orphan.bin\nhttps://example.com/a\n",
+			want:    []item{{url: "https://example.com/a", headers: map[string]string{}}},
+		},
+		{
+			name:    "options of a skipped URI",
+			content: "ftp://example.com/a\n  out=skipped.bin\nhttps://example.com/b\n",
+			want:    []item{{url: "https://example.com/b", headers: map[string]string{}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "batch.txt")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tasks, err := testManager(t, testConfig(t)).parseBatchFile(path, "aria2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]item, len(tasks))
+			for i, task := range tasks {
+				got[i] = item{task.URL, task.Mirrors, task.Filepath, task.Dir, task.SHA256, task.Headers}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parsed %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSlowChunkTailStolen(t *testing.T) {
+	data := testData(8 * MinStealSize)
+	var mu sync.Mutex
+	var starts []int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || r.Method != http.MethodGet {
+			serveData(w, r, data)
+			return
+		}
+		mu.Lock()
+		starts = append(starts, start)
+		mu.Unlock()
+		if start != 0 {
+			serveData(w, r, data)
+			return
+		}
+		// The first chunk trickles in, leaving its tail for the idle worker
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.Header().Set("ETag", `"test-etag"`)
+		w.WriteHeader(http.StatusPartialContent)
+		for offset := start; offset <= end; offset += 32 * 1024 {
+			if _, err := w.Write(data[offset:min(offset+32*1024, end+1)]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+	defer srv.Close()
+
+	dm := testManager(t, testConfig(t))
+	path, err := downloadFile(t, dm, srv.URL+"/file.bin", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("merged file differs from the served one (%d bytes, %v)", len(got), err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	stolen := false
+	for _, start := range starts {
+		stolen = stolen || (start != 0 && start != int64(len(data)/2))
+	}
+	if !stolen {
+		t.Errorf("no tail of the slow chunk was fetched apart (ranges from %v)", starts)
+	}
+}
+
+func TestRangeBodyMismatch(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     http.Header{"Content-Range": {"bytes 100-199/1000"}},
+		Body:       io.NopCloser(bytes.NewReader(make([]byte, 100))),
+	}
+	if _, _, err := rangeBody(resp, 0, 99); err == nil {
+		t.Error("rangeBody accepted bytes 100-199 for a request of 0-99")
+	}
+	if _, length, err := rangeBody(resp, 100, 199); err != nil || length != 100 {
+		t.Errorf("rangeBody(100, 199) = %d, %v; want 100 bytes", length, err)
+	}
+}
+
+func TestRateLimitEvenChunks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a second and a half")
+	}
+	config := testConfig(t)
+	config.RateLimit = 1 << 20
+	dm := testManager(t, config)
+	task := &DownloadTask{}
+
+	// Every chunk worker throttles its reads through the shared limiter;
+	// none may get far ahead of the others
+	const workers, read = 8, 4096
+	var received [workers]int64
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			for dm.throttle(ctx, task, read) == nil {
+				atomic.AddInt64(&received[i], read)
+			}
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		<-done
+	}
+
+	least, most, total := received[0], received[0], int64(0)
+	for _, n := range received {
+		least, most, total = min(least, n), max(most, n), total+n
+	}
+	if total > 2*config.RateLimit {
+		t.Errorf("%d bytes in 1.5s, over a 1 MB/s limit", total)
+	}
+	if least == 0 || most > 2*least {
+		t.Errorf("uneven progress across chunks: %v", received)
+	}
+}
+
+// BenchmarkMergeChunks copies 16 chunk files into a preallocated output,
+// one at a time (workers=1, the old sequential merge) and with
+// merge_workers' default of 4. Set FASTDL_BENCH_MERGE_MB for a larger file,
+// e.g. 4096 to measure on multi-GB downloads.
+func BenchmarkMergeChunks(b *testing.B) {
+	size := int64(64)
+	if mb, err := strconv.ParseInt(os.Getenv("FASTDL_BENCH_MERGE_MB"), 10, 64); err == nil && mb > 0 {
+		size = mb
+	}
+	size <<= 20
+	const chunks = 16
+	dir := b.TempDir()
+	block := testData(1 << 20)
+	writeChunks := func() []ChunkInfo {
+		infos := make([]ChunkInfo, chunks)
+		for i := range infos {
+			start, end := size*int64(i)/chunks, size*int64(i+1)/chunks-1
+			infos[i] = ChunkInfo{ID: i, Start: start, End: end, Path: filepath.Join(dir, "chunk"+strconv.Itoa(i))}
+			f, err := os.Create(infos[i].Path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for left := end - start + 1; left > 0; left -= int64(len(block)) {
+				f.Write(block[:min(left, int64(len(block)))])
+			}
+			f.Close()
+		}
+		return infos
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			config := DefaultConfig()
+			config.MergeWorkers = workers
+			dm, err := NewDownloadManager(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			output := filepath.Join(dir, "output")
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				infos := writeChunks()
+				os.Remove(output)
+				b.StartTimer()
+				if err := dm.mergeChunks(output, infos); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecompressKeepsNameOfPlainFile(t *testing.T) {
+	data := testData(64 * 1024)
+	var packed bytes.Buffer
+	zw := gzip.NewWriter(&packed)
+	zw.Write(data)
+	zw.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.bin.gz" {
+			serveData(w, r, packed.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	config := testConfig(t)
+	config.Decompress = true
+	dm := testManager(t, config)
+	for _, tc := range []struct{ url, name, want string }{
+		{"/file.bin.gz", "", "file.bin"},
+		{"/plain", "plain.gz", "plain.gz"}, // not compressed: saved as is, under its own name
+	} {
+		task := &DownloadTask{URL: srv.URL + tc.url, Filepath: tc.name, Chunks: 1}
+		if _, err := dm.Download(context.Background(), task); err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		got, err := os.ReadFile(filepath.Join(config.DownloadDir, tc.want))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: %s differs from the data (%d bytes, %v)", tc.url, tc.want, len(got), err)
+		}
+	}
+}
+
+func TestEncodedRangeFallsBackToSingleStream(t *testing.T) {
+	data := testData(300 * 1000)
+	var ranged, whole int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var first, last int64
+		if n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); n < 2 || r.Method == http.MethodHead || last-first < 1 {
+			if r.Method == http.MethodGet && n == 0 {
+				atomic.AddInt32(&whole, 1)
+			}
+			serveData(w, r, data)
+			return
+		}
+		// A misconfigured proxy: the slice gzipped, Content-Range still
+		// counting the plain bytes
+		atomic.AddInt32(&ranged, 1)
+		var body bytes.Buffer
+		zw := gzip.NewWriter(&body)
+		zw.Write(data[first : last+1])
+		zw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body.Bytes())
+	}))
+	defer srv.Close()
+
+	dm := testManager(t, testConfig(t))
+	path, err := downloadFile(t, dm, srv.URL+"/file.bin", 4)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if ranged == 0 {
+		t.Fatal("no ranged request was made")
+	}
+	if whole != 1 {
+		t.Errorf("%d whole-file requests after the encoded ranges, want 1", whole)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+	}
+}
+
+func TestLoadConfigRejectsMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name, file, content string
+		want                string // error substring, "" = loads fine
+	}{
+		{"valid", "config.json", `{"max_connections": 8, "daemon_port": 9090}`, ""},
+		{"valid yaml", "config.yaml", "max_connections: 8\n", ""},
+		{"unknown key", "config.json", `{"max_connection": 8}`, `unknown setting "max_connection" (did you mean "max_connections"?)`},
+		{"unknown yaml key", "config.yaml", "max_connection: 8\n", `unknown setting "max_connection"`},
+		{"unknown toml key", "config.toml", "max_connection = 8\n", `unknown setting "max_connection"`},
+		{"negative max_connections", "config.json", `{"max_connections": -4}`, "max_connections is -4; it can't be negative"},
+		{"zero max_connections", "config.json", `{"max_connections": 0}`, "max_connections is 0; it needs at least 1"},
+		{"daemon_port too high", "config.json", `{"daemon_port": 70000}`, "daemon_port 70000 is not a port"},
+		{"daemon_port zero", "config.yaml", "daemon_port: 0\n", "daemon_port 0 is not a port"},
+		{"empty download_dir", "config.json", `{"download_dir": ""}`, "download_dir is empty"},
+		{"blank download_dir", "config.toml", "download_dir = \"  \"\n", "download_dir is empty"},
+		{"bad ip_version", "config.json", `{"ip_version": "5"}`, "ip_version"},
+		{"wrong type", "config.json", `{"max_connections": "lots"}`, "failed to parse"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("LoadConfig: %v", err)
+			case tc.want == "" && config.MaxConnections != 8:
+				t.Fatalf("max_connections %d, want 8", config.MaxConnections)
+			case tc.want != "" && err == nil:
+				t.Fatalf("LoadConfig accepted %s", tc.content)
+			case tc.want != "" && !strings.Contains(err.Error(), tc.want):
+				t.Fatalf("error %q, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"negative max_connections", func(c *Config) { c.MaxConnections = -1 }},
+		{"negative rate_limit", func(c *Config) { c.RateLimit = -1 }},
+		{"zero max_retries", func(c *Config) { c.MaxRetries = 0 }},
+		{"daemon_port above 65535", func(c *Config) { c.DaemonPort = 65536 }},
+		{"empty download_dir", func(c *Config) { c.DownloadDir = "" }},
+		{"rpc without a port", func(c *Config) { c.EnableRPC, c.RPCPort = true, 0 }},
+		{"bad checksum_algorithm", func(c *Config) { c.ChecksumAlgorithm = "crc32" }},
+		{"bad proxy", func(c *Config) { c.ProxyURL = "ftp://proxy:21" }},
+	} {
+		config := DefaultConfig()
+		tc.modify(config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted it", tc.name)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package fastdl
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyAt copies the n bytes of src to dst at offset with copy_file_range(2),
+// so the data never passes through user space. Where the kernel can't (across
+// filesystems, or without support) it falls back to a buffered copy, with the
+// page cache told the reads are sequential.
+func copyAt(dst *os.File, offset int64, src *os.File, n int64) error {
+	var read int64
+	for read < n {
+		copied, err := unix.CopyFileRange(int(src.Fd()), &read, int(dst.Fd()), &offset, int(n-read), 0)
+		if err != nil && read == 0 && (err == unix.EXDEV || err == unix.ENOSYS || err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+			unix.Fadvise(int(src.Fd()), 0, n, unix.FADV_SEQUENTIAL)
+			return bufferedCopyAt(dst, offset, src, n)
+		}
+		if err != nil {
+			return err
+		}
+		if copied == 0 {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
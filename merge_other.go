@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fastdl
+
+import "os"
+
+// copyAt copies the n bytes of src to dst at offset
+func copyAt(dst *os.File, offset int64, src *os.File, n int64) error {
+	return bufferedCopyAt(dst, offset, src, n)
+}
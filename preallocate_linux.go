@@ -0,0 +1,19 @@
+//go:build linux
+
+package fastdl
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for f with fallocate(2) so disk-full errors
+// surface immediately and large files are laid out contiguously. Filesystems
+// without fallocate support fall back to a sparse Truncate.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
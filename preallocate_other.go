@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fastdl
+
+import "os"
+
+// preallocate sizes f up front. Without fallocate this creates a sparse file.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
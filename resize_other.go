@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fastdl
+
+import "os"
+
+// notifyResize has no resize signal to watch here; the progress line still
+// picks up a new width on its next update
+func notifyResize() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package fastdl
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyResize returns a channel that receives on terminal resizes
+// (SIGWINCH) and a function to stop the notifications
+func notifyResize() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	return ch, func() { signal.Stop(ch) }
+}
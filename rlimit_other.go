@@ -0,0 +1,9 @@
+//go:build !unix
+
+package fastdl
+
+// softFileLimit has no RLIMIT_NOFILE to read here: openFileLimit falls back
+// to DefaultOpenFiles
+func softFileLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package fastdl
+
+import "syscall"
+
+// softFileLimit returns the soft RLIMIT_NOFILE, 0 when it can't be read
+func softFileLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil || limit.Cur <= 0 {
+		return 0
+	}
+	return uint64(limit.Cur)
+}